@@ -1,9 +1,17 @@
-package main
+package errors
 
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Inspired by https://google.aip.dev/193
@@ -24,7 +32,11 @@ const (
 	ErrorUnauthenticated ErrorCode = "UNAUTHENTICATED"
 	// ErrorPermissionDenied - The caller does not have permission to execute the specified operation.
 	ErrorPermissionDenied ErrorCode = "PERMISSION_DENIED"
-	// ErrorTooManyRequests - The caller has exhausted their rate limit or quota
+	// ErrorTooManyRequests - The caller has exhausted their rate limit or quota. Predates
+	// ErrorResourceExhausted and is kept for backwards compatibility; the two are intentionally
+	// aliased to the same HTTP status (429) and gRPC code (8) in StatusCodeMap/GRPCCodeMap, which
+	// makes FromHTTPStatus[429] and FromGRPCCode[8] lossy for this pair - they always resolve to
+	// ErrorResourceExhausted, the canonical AIP-193 name. Prefer ErrorResourceExhausted in new code.
 	ErrorTooManyRequests ErrorCode = "TOO_MANY_REQUESTS"
 	// ErrorInternal - The part of the underlying system is broken
 	ErrorInternal ErrorCode = "INTERNAL"
@@ -32,6 +44,22 @@ const (
 	ErrorUnknown ErrorCode = "UNKNOWN"
 	// ErrorUnavailable - The service is currently unavailable. Can be retried with a backoff.
 	ErrorUnavailable ErrorCode = "UNAVAILABLE"
+	// ErrorCancelled - The operation was cancelled, typically by the caller.
+	ErrorCancelled ErrorCode = "CANCELLED"
+	// ErrorDeadlineExceeded - The operation did not complete within the deadline allocated to it.
+	ErrorDeadlineExceeded ErrorCode = "DEADLINE_EXCEEDED"
+	// ErrorAborted - The operation was aborted, typically due to a concurrency issue such as a sequencer check failure or transaction abort.
+	ErrorAborted ErrorCode = "ABORTED"
+	// ErrorOutOfRange - The operation was attempted past the valid range, e.g. seeking past the end of a file.
+	ErrorOutOfRange ErrorCode = "OUT_OF_RANGE"
+	// ErrorUnimplemented - The operation is not implemented or is not supported/enabled in this service.
+	ErrorUnimplemented ErrorCode = "UNIMPLEMENTED"
+	// ErrorDataLoss - Unrecoverable data loss or corruption.
+	ErrorDataLoss ErrorCode = "DATA_LOSS"
+	// ErrorResourceExhausted - The resource has been exhausted, e.g. a per-user quota, or the entire file system is out of space.
+	// The canonical AIP-193 counterpart to the legacy ErrorTooManyRequests; see its doc comment
+	// for the resulting aliasing in StatusCodeMap/GRPCCodeMap/FromHTTPStatus/FromGRPCCode.
+	ErrorResourceExhausted ErrorCode = "RESOURCE_EXHAUSTED"
 )
 
 var StatusCodeMap = map[ErrorCode]int{
@@ -45,6 +73,73 @@ var StatusCodeMap = map[ErrorCode]int{
 	ErrorInternal:           http.StatusInternalServerError,
 	ErrorUnknown:            http.StatusInternalServerError,
 	ErrorUnavailable:        http.StatusServiceUnavailable,
+	ErrorCancelled:          499,
+	ErrorDeadlineExceeded:   http.StatusGatewayTimeout,
+	ErrorAborted:            http.StatusConflict,
+	ErrorOutOfRange:         http.StatusBadRequest,
+	ErrorUnimplemented:      http.StatusNotImplemented,
+	ErrorDataLoss:           http.StatusInternalServerError,
+	ErrorResourceExhausted:  http.StatusTooManyRequests,
+}
+
+// GRPCCodeMap maps an ErrorCode to its numeric google.rpc.Code / gRPC status code value.
+var GRPCCodeMap = map[ErrorCode]uint32{
+	ErrorCancelled:          1,
+	ErrorUnknown:            2,
+	ErrorInvalidArgument:    3,
+	ErrorDeadlineExceeded:   4,
+	ErrorNotFound:           5,
+	ErrorAlreadyExists:      6,
+	ErrorPermissionDenied:   7,
+	ErrorResourceExhausted:  8,
+	ErrorTooManyRequests:    8,
+	ErrorFailedPrecondition: 9,
+	ErrorAborted:            10,
+	ErrorOutOfRange:         11,
+	ErrorUnimplemented:      12,
+	ErrorInternal:           13,
+	ErrorUnavailable:        14,
+	ErrorDataLoss:           15,
+	ErrorUnauthenticated:    16,
+}
+
+// FromHTTPStatus maps an HTTP status code back to the ErrorCode recommended by AIP-193 for it.
+// This is lossy where StatusCodeMap maps more than one ErrorCode to the same status: 429 maps
+// back to ErrorResourceExhausted even though ErrorTooManyRequests also maps to 429.
+var FromHTTPStatus = map[int]ErrorCode{
+	http.StatusBadRequest:          ErrorInvalidArgument,
+	http.StatusUnauthorized:        ErrorUnauthenticated,
+	http.StatusForbidden:           ErrorPermissionDenied,
+	http.StatusNotFound:            ErrorNotFound,
+	http.StatusConflict:            ErrorAlreadyExists,
+	http.StatusTooManyRequests:     ErrorResourceExhausted,
+	499:                            ErrorCancelled,
+	http.StatusInternalServerError: ErrorInternal,
+	http.StatusNotImplemented:      ErrorUnimplemented,
+	http.StatusServiceUnavailable:  ErrorUnavailable,
+	http.StatusGatewayTimeout:      ErrorDeadlineExceeded,
+}
+
+// FromGRPCCode maps a numeric gRPC status code back to the corresponding ErrorCode. This is
+// lossy where GRPCCodeMap maps more than one ErrorCode to the same code: 8 maps back to
+// ErrorResourceExhausted even though ErrorTooManyRequests also maps to 8.
+var FromGRPCCode = map[uint32]ErrorCode{
+	1:  ErrorCancelled,
+	2:  ErrorUnknown,
+	3:  ErrorInvalidArgument,
+	4:  ErrorDeadlineExceeded,
+	5:  ErrorNotFound,
+	6:  ErrorAlreadyExists,
+	7:  ErrorPermissionDenied,
+	8:  ErrorResourceExhausted,
+	9:  ErrorFailedPrecondition,
+	10: ErrorAborted,
+	11: ErrorOutOfRange,
+	12: ErrorUnimplemented,
+	13: ErrorInternal,
+	14: ErrorUnavailable,
+	15: ErrorDataLoss,
+	16: ErrorUnauthenticated,
 }
 
 func (e ErrorCode) String() string {
@@ -57,26 +152,164 @@ type ErrorDetail any
 type ApiError struct {
 	Code    ErrorCode `json:"code"`
 	Message string    `json:"message"`
-	// Details provide more context to an error. The predefined structs are ErrorInfo | BadRequest | LocalizedMessage
+	// Details provide more context to an error. The predefined structs are ErrorInfo | BadRequest | LocalizedMessage |
+	// RetryInfo | QuotaFailure | PreconditionFailure | ResourceInfo | DebugInfo | Help | RequestInfo
 	Details []ErrorDetail `json:"details"`
+	// cause is the underlying error that led to this ApiError, if any. It is not serialized and
+	// is only reachable via Unwrap, so it never leaks internal details to clients.
+	cause error
+	// stack holds the raw program counters captured at construction time, if stack capture is
+	// enabled via WithStackTrace. It is resolved lazily into Frames by StackTrace.
+	stack []uintptr
+}
+
+// stackTraceEnabled is the WithStackTrace toggle. Stack capture is off by default: it is a
+// local-development aid and runtime.Callers is too costly to pay on every error in production.
+var stackTraceEnabled atomic.Bool
+
+// WithStackTrace turns stack capture in NewApiError on or off for the process. It is intended to
+// be set once at startup, e.g. enabled when running in development and left off in production.
+func WithStackTrace(enabled bool) {
+	stackTraceEnabled.Store(enabled)
 }
 
-// NewApiError constructs the Error with details being ErrorInfo | BadRequest | LocalizedMessage
+// stackCaptureSkip is the runtime.Callers skip count that makes the first captured frame the
+// caller of NewApiError rather than NewApiError itself: 0 is runtime.Callers, 1 is NewApiError,
+// 2 is its caller.
+const stackCaptureSkip = 2
+
+// NewApiError constructs the Error with details being ErrorInfo | BadRequest | LocalizedMessage |
+// RetryInfo | QuotaFailure | PreconditionFailure | ResourceInfo | DebugInfo | Help | RequestInfo
 func NewApiError(status ErrorCode, err string, details []ErrorDetail) ApiError {
 	if details == nil {
 		details = make([]ErrorDetail, 0)
 	}
-	return ApiError{
-		status,
-		err,
-		details,
+	ae := ApiError{
+		Code:    status,
+		Message: err,
+		Details: details,
+	}
+	if stackTraceEnabled.Load() {
+		pcs := make([]uintptr, 32)
+		n := runtime.Callers(stackCaptureSkip, pcs)
+		ae.stack = pcs[:n]
 	}
+	return ae
+}
+
+// Frame is one resolved entry of an ApiError's captured stack trace.
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// StackTrace resolves and returns the stack captured at construction time, or nil if stack
+// capture was disabled (the default) when e was constructed.
+func (e ApiError) StackTrace() []Frame {
+	if len(e.stack) == 0 {
+		return nil
+	}
+	framesIter := runtime.CallersFrames(e.stack)
+	frames := make([]Frame, 0, len(e.stack))
+	for {
+		frame, more := framesIter.Next()
+		frames = append(frames, Frame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		if !more {
+			break
+		}
+	}
+	return frames
 }
 
 func (e ApiError) Error() string {
 	return fmt.Sprintf("ApiError { code: %s, message: %s, details: %+v }", e.Code, e.Message, e.Details)
 }
 
+// Wrap returns a copy of e with err recorded as its cause, reachable via Unwrap/errors.Unwrap.
+func (e ApiError) Wrap(err error) ApiError {
+	e.cause = err
+	return e
+}
+
+// Unwrap returns the error passed to Wrap, or nil if none was set, so that errors.Unwrap and
+// errors.As can reach the underlying cause.
+func (e ApiError) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is an ApiError with the same Code, so that errors.Is(err, ErrNotFound)
+// works regardless of Message, Details, or cause.
+func (e ApiError) Is(target error) bool {
+	t, ok := target.(ApiError)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code
+}
+
+// Sentinel ApiErrors for use with errors.Is, one per ErrorCode. Only Code is significant for
+// matching; Message and Details are left empty.
+var (
+	ErrInvalidArgument    = ApiError{Code: ErrorInvalidArgument}
+	ErrFailedPrecondition = ApiError{Code: ErrorFailedPrecondition}
+	ErrNotFound           = ApiError{Code: ErrorNotFound}
+	ErrAlreadyExists      = ApiError{Code: ErrorAlreadyExists}
+	ErrUnauthenticated    = ApiError{Code: ErrorUnauthenticated}
+	ErrPermissionDenied   = ApiError{Code: ErrorPermissionDenied}
+	ErrTooManyRequests    = ApiError{Code: ErrorTooManyRequests}
+	ErrInternal           = ApiError{Code: ErrorInternal}
+	ErrUnknown            = ApiError{Code: ErrorUnknown}
+	ErrUnavailable        = ApiError{Code: ErrorUnavailable}
+	ErrCancelled          = ApiError{Code: ErrorCancelled}
+	ErrDeadlineExceeded   = ApiError{Code: ErrorDeadlineExceeded}
+	ErrAborted            = ApiError{Code: ErrorAborted}
+	ErrOutOfRange         = ApiError{Code: ErrorOutOfRange}
+	ErrUnimplemented      = ApiError{Code: ErrorUnimplemented}
+	ErrDataLoss           = ApiError{Code: ErrorDataLoss}
+	ErrResourceExhausted  = ApiError{Code: ErrorResourceExhausted}
+)
+
+// GetErrorInfo returns the first ErrorInfo detail attached to e, if any.
+func GetErrorInfo(e ApiError) (*ErrorInfo, bool) {
+	for _, d := range e.Details {
+		if info, ok := d.(ErrorInfo); ok {
+			return &info, true
+		}
+	}
+	return nil, false
+}
+
+// GetBadRequest returns the first BadRequest detail attached to e, if any.
+func GetBadRequest(e ApiError) (*BadRequest, bool) {
+	for _, d := range e.Details {
+		if br, ok := d.(BadRequest); ok {
+			return &br, true
+		}
+	}
+	return nil, false
+}
+
+// NewApiErrorFromHTTPStatus constructs an ApiError from an HTTP status code, looking up the
+// ErrorCode recommended by AIP-193 for that status. Unrecognized status codes map to ErrorUnknown.
+func NewApiErrorFromHTTPStatus(status int, err string) ApiError {
+	code, ok := FromHTTPStatus[status]
+	if !ok {
+		code = ErrorUnknown
+	}
+	return NewApiError(code, err, nil)
+}
+
+// NewApiErrorFromGRPCCode constructs an ApiError from a numeric gRPC status code. Unrecognized
+// codes map to ErrorUnknown.
+func NewApiErrorFromGRPCCode(code uint32, err string) ApiError {
+	ec, ok := FromGRPCCode[code]
+	if !ok {
+		ec = ErrorUnknown
+	}
+	return NewApiError(ec, err, nil)
+}
+
 // The ErrorInfo message is the primary way to send a __machine-readable__ identifier. Contextual information should be included in metadata in ErrorInfo and must be included if it appears within an error message.
 type ErrorInfo struct {
 	Type string `json:"@type"`
@@ -95,6 +328,10 @@ type ErrorInfo struct {
 	//    THE_BOOK_YOU_WANT_IS_NOT_AVAILABLE (overly verbose)
 	//    ERROR (too general)
 	Reason string `json:"reason"`
+	// The Domain field is the logical grouping to which the Reason belongs, typically the
+	// registering service's domain, e.g. "pubsub.googleapis.com". Left empty by NewErrorInfo;
+	// set automatically by RegisteredError.New.
+	Domain string `json:"domain,omitempty"`
 	// The Metadata field is a map of key/value pairs providing additional dynamic information as context.
 	// Each __key__ within metadata must conform to the regular expression [a-z][a-zA-Z0-9-_]+.
 	// The ErrorInfo.metadata map for the same error could be:
@@ -187,9 +424,392 @@ func NewLocalizedMessage(locale, message string) LocalizedMessage {
 	}
 }
 
+// RetryInfo describes when clients may retry a failed request. Clients should wait at least
+// RetryDelay before retrying the request that caused this error.
+type RetryInfo struct {
+	Type       string        `json:"@type"`
+	RetryDelay time.Duration `json:"retryDelay"`
+}
+
+func NewRetryInfo(retryDelay time.Duration) RetryInfo {
+	return RetryInfo{
+		Type:       "RETRY_INFO",
+		RetryDelay: retryDelay,
+	}
+}
+
+func (r RetryInfo) MarshalJSON() ([]byte, error) {
+	type alias struct {
+		Type       string `json:"@type"`
+		RetryDelay string `json:"retryDelay"`
+	}
+	return json.Marshal(alias{Type: r.Type, RetryDelay: formatProtoDuration(r.RetryDelay)})
+}
+
+func (r *RetryInfo) UnmarshalJSON(data []byte) error {
+	var alias struct {
+		Type       string `json:"@type"`
+		RetryDelay string `json:"retryDelay"`
+	}
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	delay, err := time.ParseDuration(alias.RetryDelay)
+	if err != nil {
+		return err
+	}
+	r.Type = alias.Type
+	r.RetryDelay = delay
+	return nil
+}
+
+// formatProtoDuration renders d using the protobuf google.protobuf.Duration JSON text format:
+// a possibly-fractional number of seconds followed by "s" (e.g. "5s", "1.5s"). The result is
+// also a valid input to time.ParseDuration.
+func formatProtoDuration(d time.Duration) string {
+	negative := d < 0
+	if negative {
+		d = -d
+	}
+	seconds := int64(d / time.Second)
+	nanos := int64(d % time.Second)
+	var s string
+	if nanos == 0 {
+		s = fmt.Sprintf("%d", seconds)
+	} else {
+		s = strings.TrimRight(fmt.Sprintf("%d.%09d", seconds, nanos), "0")
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s + "s"
+}
+
+// QuotaViolation describes a single instance of a quota check failure.
+type QuotaViolation struct {
+	// The Subject field identifies the subject on which the quota check failed, e.g. "clientip:<ip address of client>" or "project:<Google developer project id>".
+	Subject string `json:"subject"`
+	// The Description field is a human-readable explanation of why the quota was exceeded.
+	Description string `json:"description"`
+}
+
+// QuotaFailure describes how a quota check failed. For example, if a daily limit was exceeded
+// for the calling project, a service could respond with a QuotaFailure detail containing the
+// project id and the description of the quota limit that was exceeded.
+type QuotaFailure struct {
+	Type       string           `json:"@type"`
+	Violations []QuotaViolation `json:"violations"`
+}
+
+func NewQuotaFailure(violations []QuotaViolation) QuotaFailure {
+	return QuotaFailure{
+		Type:       "QUOTA_FAILURE",
+		Violations: violations,
+	}
+}
+
+// PreconditionViolation describes a single precondition failure.
+type PreconditionViolation struct {
+	// The Type field is the type of PreconditionFailure, e.g. "TOS" for a terms-of-service violation.
+	Type string `json:"type"`
+	// The Subject field identifies the subject, relative to the type, that failed, e.g. "google.com/cloud" relative to the "TOS" type.
+	Subject string `json:"subject"`
+	// A description of how the precondition failed, developer-facing, not intended for the client to display.
+	Description string `json:"description"`
+}
+
+// PreconditionFailure describes what preconditions have failed. For example, if an RPC failed
+// because it required the terms of service to be acknowledged, this detail would list the
+// terms of service violation.
+type PreconditionFailure struct {
+	Type       string                  `json:"@type"`
+	Violations []PreconditionViolation `json:"violations"`
+}
+
+func NewPreconditionFailure(violations []PreconditionViolation) PreconditionFailure {
+	return PreconditionFailure{
+		Type:       "PRECONDITION_FAILURE",
+		Violations: violations,
+	}
+}
+
+// ResourceInfo describes the resource that is being accessed when the error happened.
+type ResourceInfo struct {
+	Type string `json:"@type"`
+	// The ResourceType field is the type of resource being accessed, e.g. "sql table", "file", or the canonical resource type, e.g. "compute.googleapis.com/Disk".
+	ResourceType string `json:"resourceType"`
+	// The ResourceName field is the name of the resource being accessed, e.g. the file name the error is happening on.
+	ResourceName string `json:"resourceName"`
+	// The Owner field is the owner of the resource, e.g. user name for a file, or the project id a Cloud resource belongs to.
+	Owner string `json:"owner"`
+	// A description of the error, may be used in locales other than English.
+	Description string `json:"description"`
+}
+
+func NewResourceInfo(resourceType, resourceName, owner, description string) ResourceInfo {
+	return ResourceInfo{
+		Type:         "RESOURCE_INFO",
+		ResourceType: resourceType,
+		ResourceName: resourceName,
+		Owner:        owner,
+		Description:  description,
+	}
+}
+
+// DebugInfo describes additional debugging info. It is intended for use in development and
+// should be stripped before returning errors to untrusted clients in production.
+type DebugInfo struct {
+	Type string `json:"@type"`
+	// The StackEntries field holds the stack trace entries indicating where the error occurred.
+	StackEntries []string `json:"stackEntries"`
+	// The Detail field is any data that the server wants to communicate for debugging purposes only.
+	Detail string `json:"detail"`
+}
+
+func NewDebugInfo(stackEntries []string, detail string) DebugInfo {
+	return DebugInfo{
+		Type:         "DEBUG_INFO",
+		StackEntries: stackEntries,
+		Detail:       detail,
+	}
+}
+
+// HelpLink describes a URL link that should be followed to get more information about the error.
+type HelpLink struct {
+	// A description of what the link offers.
+	Description string `json:"description"`
+	// The URL field is the URL of the link.
+	URL string `json:"url"`
+}
+
+// Help provides links to documentation or for performing an out-of-band action, e.g. asking a
+// user to go to an account page to resolve an issue.
+type Help struct {
+	Type  string     `json:"@type"`
+	Links []HelpLink `json:"links"`
+}
+
+func NewHelp(links []HelpLink) Help {
+	return Help{
+		Type:  "HELP",
+		Links: links,
+	}
+}
+
+// RequestInfo describes the raw request that was used to invoke the underlying API and an
+// identifier that can be used to find related debugging information.
+type RequestInfo struct {
+	Type string `json:"@type"`
+	// The RequestID field is an opaque string that should only be interpreted by the service that generated it, e.g. a server trace id.
+	RequestID string `json:"requestId"`
+	// The ServingData field is any data that was used to serve this request, e.g. an encoded stream cursor that was used to resume a streaming RPC.
+	ServingData string `json:"servingData"`
+}
+
+func NewRequestInfo(requestID, servingData string) RequestInfo {
+	return RequestInfo{
+		Type:        "REQUEST_INFO",
+		RequestID:   requestID,
+		ServingData: servingData,
+	}
+}
+
+// reasonPattern is the AIP-193 format for ErrorInfo.Reason: UPPER_SNAKE_CASE, without leading
+// or trailing underscores, and without leading digits.
+var reasonPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]+[A-Z0-9]$`)
+
+// metadataKeyPattern is the AIP-193 format for ErrorInfo.Metadata keys: lowerCamelCase, starting
+// with a lowercase letter.
+var metadataKeyPattern = regexp.MustCompile(`^[a-z][a-zA-Z0-9-_]+$`)
+
+// RegisteredError is a domain-scoped error reason registered via Register. Services extend the
+// shared ErrorCode taxonomy by registering their own reasons instead of forking this package.
+type RegisteredError struct {
+	Domain      string
+	Reason      string
+	DefaultCode ErrorCode
+	Message     string
+}
+
+// registryKey identifies a RegisteredError by the (domain, reason) pair it was registered under.
+type registryKey struct {
+	domain string
+	reason string
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[registryKey]*RegisteredError{}
+)
+
+// Register adds reason to the global registry for domain, associating it with defaultCode and a
+// default message. It panics if reason does not match the AIP-193 reason format, mirroring
+// regexp.MustCompile: registrations happen at package init time, so a malformed reason is a
+// programmer error that should fail fast rather than surface at request time.
+func Register(domain string, reason string, defaultCode ErrorCode, message string) *RegisteredError {
+	if !reasonPattern.MatchString(reason) {
+		panic(fmt.Sprintf("errors: invalid reason %q for domain %q: must match %s", reason, domain, reasonPattern))
+	}
+	re := &RegisteredError{
+		Domain:      domain,
+		Reason:      reason,
+		DefaultCode: defaultCode,
+		Message:     message,
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[registryKey{domain, reason}] = re
+	return re
+}
+
+// LookupReason returns the RegisteredError previously registered for domain and reason, if any.
+func LookupReason(domain, reason string) (*RegisteredError, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	re, ok := registry[registryKey{domain, reason}]
+	return re, ok
+}
+
+// New constructs an ApiError using r's default code and message, auto-attaching an ErrorInfo
+// detail built from r's domain and reason plus the given metadata. Each metadata key must match
+// the AIP-193 metadata key format; this is not validated here but can be checked with
+// ApiError.Validate.
+func (r *RegisteredError) New(metadata map[string]any, details ...ErrorDetail) ApiError {
+	info := ErrorInfo{
+		Type:     "ERROR_INFO",
+		Reason:   r.Reason,
+		Domain:   r.Domain,
+		Metadata: metadata,
+	}
+	return NewApiError(r.DefaultCode, r.Message, append([]ErrorDetail{info}, details...))
+}
+
+// Validate reports whether e conforms to the AIP-193 format requirements for its ErrorInfo
+// details: Reason must be UPPER_SNAKE_CASE and every Metadata key must be lowerCamelCase. It lets
+// tests catch spec violations at CI time rather than discovering them in a client SDK.
+func (e ApiError) Validate() error {
+	for _, d := range e.Details {
+		info, ok := d.(ErrorInfo)
+		if !ok {
+			continue
+		}
+		if !reasonPattern.MatchString(info.Reason) {
+			return fmt.Errorf("errors: ErrorInfo.Reason %q is invalid: must match %s", info.Reason, reasonPattern)
+		}
+		for key := range info.Metadata {
+			if !metadataKeyPattern.MatchString(key) {
+				return fmt.Errorf("errors: ErrorInfo.Metadata key %q is invalid: must match %s", key, metadataKeyPattern)
+			}
+		}
+	}
+	return nil
+}
+
 // WriteHTTPResponse writes the ApiError as an HTTP response
 func (e ApiError) WriteHTTPResponse(w http.ResponseWriter) error {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(StatusCodeMap[e.Code])
 	return json.NewEncoder(w).Encode(e)
 }
+
+// WriteHTTPResponseDebug writes the ApiError as an HTTP response, same as WriteHTTPResponse,
+// except that when includeStack is true and e has a captured stack trace it is appended as a
+// DebugInfo detail. Intended for local development; callers should pass includeStack=false (or
+// just use WriteHTTPResponse) in production so stack frames are never exposed to clients.
+func (e ApiError) WriteHTTPResponseDebug(w http.ResponseWriter, includeStack bool) error {
+	if includeStack {
+		if frames := e.StackTrace(); len(frames) > 0 {
+			entries := make([]string, len(frames))
+			for i, f := range frames {
+				entries[i] = fmt.Sprintf("%s\n\t%s:%d", f.Function, f.File, f.Line)
+			}
+			details := make([]ErrorDetail, len(e.Details), len(e.Details)+1)
+			copy(details, e.Details)
+			e.Details = append(details, NewDebugInfo(entries, ""))
+		}
+	}
+	return e.WriteHTTPResponse(w)
+}
+
+// rawApiError mirrors ApiError but defers decoding of Details until each entry's @type is known.
+type rawApiError struct {
+	Code    ErrorCode         `json:"code"`
+	Message string            `json:"message"`
+	Details []json.RawMessage `json:"details"`
+}
+
+// ParseApiError reads and closes resp.Body, decoding it as an ApiError.
+func ParseApiError(resp *http.Response) (ApiError, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ApiError{}, err
+	}
+	return UnmarshalApiError(body)
+}
+
+// UnmarshalApiError decodes body as an ApiError, unmarshalling each entry in Details into the
+// concrete Go struct matching its "@type" rather than leaving it as a map[string]any.
+func UnmarshalApiError(body []byte) (ApiError, error) {
+	var raw rawApiError
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return ApiError{}, err
+	}
+	details := make([]ErrorDetail, 0, len(raw.Details))
+	for _, rawDetail := range raw.Details {
+		detail, err := unmarshalErrorDetail(rawDetail)
+		if err != nil {
+			return ApiError{}, err
+		}
+		details = append(details, detail)
+	}
+	return ApiError{Code: raw.Code, Message: raw.Message, Details: details}, nil
+}
+
+// unmarshalErrorDetail decodes a single details entry into the concrete struct matching its
+// "@type". Unrecognized types fall back to map[string]any so forward compatibility is preserved.
+func unmarshalErrorDetail(rawDetail json.RawMessage) (ErrorDetail, error) {
+	var discriminator struct {
+		Type string `json:"@type"`
+	}
+	if err := json.Unmarshal(rawDetail, &discriminator); err != nil {
+		return nil, err
+	}
+
+	var detail ErrorDetail
+	switch discriminator.Type {
+	case "ERROR_INFO":
+		detail = &ErrorInfo{}
+	case "BAD_REQUEST":
+		detail = &BadRequest{}
+	case "LOCALIZED_MESSAGE":
+		detail = &LocalizedMessage{}
+	case "RETRY_INFO":
+		detail = &RetryInfo{}
+	case "QUOTA_FAILURE":
+		detail = &QuotaFailure{}
+	case "PRECONDITION_FAILURE":
+		detail = &PreconditionFailure{}
+	case "RESOURCE_INFO":
+		detail = &ResourceInfo{}
+	case "DEBUG_INFO":
+		detail = &DebugInfo{}
+	case "HELP":
+		detail = &Help{}
+	case "REQUEST_INFO":
+		detail = &RequestInfo{}
+	default:
+		var unknown map[string]any
+		if err := json.Unmarshal(rawDetail, &unknown); err != nil {
+			return nil, err
+		}
+		return unknown, nil
+	}
+
+	if err := json.Unmarshal(rawDetail, detail); err != nil {
+		return nil, err
+	}
+	// Dereference the pointer so callers can type-switch/type-assert on the value types that
+	// NewX constructors return, e.g. d.(ErrorInfo) rather than d.(*ErrorInfo).
+	return reflect.ValueOf(detail).Elem().Interface(), nil
+}
@@ -1,11 +1,14 @@
-package main
+package errors
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestError_Specification(t *testing.T) {
@@ -101,3 +104,346 @@ func TestError_Specification(t *testing.T) {
 		}
 	})
 }
+
+// TestErrorCode_AIP193Conformance asserts that StatusCodeMap and GRPCCodeMap agree with the
+// HTTP mapping recommended by https://google.aip.dev/193 for the codes it covers.
+func TestErrorCode_AIP193Conformance(t *testing.T) {
+	cases := []struct {
+		code       ErrorCode
+		httpStatus int
+		grpcCode   uint32
+	}{
+		{ErrorAborted, http.StatusConflict, 10},
+		{ErrorOutOfRange, http.StatusBadRequest, 11},
+		{ErrorResourceExhausted, http.StatusTooManyRequests, 8},
+		{ErrorUnimplemented, http.StatusNotImplemented, 12},
+		{ErrorDataLoss, http.StatusInternalServerError, 15},
+	}
+	for _, tc := range cases {
+		if got := StatusCodeMap[tc.code]; got != tc.httpStatus {
+			t.Errorf("StatusCodeMap[%s] = %d, want %d", tc.code, got, tc.httpStatus)
+		}
+		if got := GRPCCodeMap[tc.code]; got != tc.grpcCode {
+			t.Errorf("GRPCCodeMap[%s] = %d, want %d", tc.code, got, tc.grpcCode)
+		}
+		if got, ok := FromHTTPStatus[tc.httpStatus]; ok && StatusCodeMap[got] != tc.httpStatus {
+			t.Errorf("FromHTTPStatus[%d] = %s, whose StatusCodeMap entry is %d, want %d", tc.httpStatus, got, StatusCodeMap[got], tc.httpStatus)
+		}
+		if got, ok := FromGRPCCode[tc.grpcCode]; ok && GRPCCodeMap[got] != tc.grpcCode {
+			t.Errorf("FromGRPCCode[%d] = %s, whose GRPCCodeMap entry is %d, want %d", tc.grpcCode, got, GRPCCodeMap[got], tc.grpcCode)
+		}
+	}
+}
+
+// TestErrorCode_ResourceExhaustedAlias documents that ErrorTooManyRequests and
+// ErrorResourceExhausted are intentionally aliased to the same HTTP status and gRPC code, which
+// makes FromHTTPStatus/FromGRPCCode lossy for this pair: they always resolve to the canonical
+// AIP-193 name, ErrorResourceExhausted.
+func TestErrorCode_ResourceExhaustedAlias(t *testing.T) {
+	if StatusCodeMap[ErrorTooManyRequests] != StatusCodeMap[ErrorResourceExhausted] {
+		t.Errorf("expected ErrorTooManyRequests and ErrorResourceExhausted to share an HTTP status")
+	}
+	if GRPCCodeMap[ErrorTooManyRequests] != GRPCCodeMap[ErrorResourceExhausted] {
+		t.Errorf("expected ErrorTooManyRequests and ErrorResourceExhausted to share a gRPC code")
+	}
+	if got := FromHTTPStatus[http.StatusTooManyRequests]; got != ErrorResourceExhausted {
+		t.Errorf("expected FromHTTPStatus[429] = %s, got %s", ErrorResourceExhausted, got)
+	}
+	if got := FromGRPCCode[GRPCCodeMap[ErrorResourceExhausted]]; got != ErrorResourceExhausted {
+		t.Errorf("expected FromGRPCCode[8] = %s, got %s", ErrorResourceExhausted, got)
+	}
+}
+
+// TestNewApiErrorFromHTTPStatus_GRPCCode asserts that NewApiErrorFromHTTPStatus and
+// NewApiErrorFromGRPCCode round-trip a known status/code through FromHTTPStatus/FromGRPCCode, and
+// fall back to ErrorUnknown for a status/code the maps don't recognize.
+func TestNewApiErrorFromHTTPStatus_GRPCCode(t *testing.T) {
+	t.Run("HTTP status round-trips to the mapped ErrorCode", func(t *testing.T) {
+		got := NewApiErrorFromHTTPStatus(http.StatusNotFound, "book not found")
+		if got.Code != ErrorNotFound {
+			t.Errorf("expected code %s, got %s", ErrorNotFound, got.Code)
+		}
+		if got.Message != "book not found" {
+			t.Errorf("expected message %q, got %q", "book not found", got.Message)
+		}
+	})
+
+	t.Run("unknown HTTP status falls back to ErrorUnknown", func(t *testing.T) {
+		got := NewApiErrorFromHTTPStatus(599, "mystery failure")
+		if got.Code != ErrorUnknown {
+			t.Errorf("expected code %s, got %s", ErrorUnknown, got.Code)
+		}
+	})
+
+	t.Run("gRPC code round-trips to the mapped ErrorCode", func(t *testing.T) {
+		got := NewApiErrorFromGRPCCode(GRPCCodeMap[ErrorNotFound], "book not found")
+		if got.Code != ErrorNotFound {
+			t.Errorf("expected code %s, got %s", ErrorNotFound, got.Code)
+		}
+	})
+
+	t.Run("unknown gRPC code falls back to ErrorUnknown", func(t *testing.T) {
+		got := NewApiErrorFromGRPCCode(999, "mystery failure")
+		if got.Code != ErrorUnknown {
+			t.Errorf("expected code %s, got %s", ErrorUnknown, got.Code)
+		}
+	})
+}
+
+func TestErrorDetails_JSON(t *testing.T) {
+	t.Run("RetryInfo", func(t *testing.T) {
+		detail := NewRetryInfo(5 * time.Second)
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"RETRY_INFO","retryDelay":"5s"}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+
+	t.Run("QuotaFailure", func(t *testing.T) {
+		detail := NewQuotaFailure([]QuotaViolation{{Subject: "project:123", Description: "daily limit exceeded"}})
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"QUOTA_FAILURE","violations":[{"subject":"project:123","description":"daily limit exceeded"}]}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+
+	t.Run("PreconditionFailure", func(t *testing.T) {
+		detail := NewPreconditionFailure([]PreconditionViolation{{Type: "TOS", Subject: "google.com/cloud", Description: "terms not accepted"}})
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"PRECONDITION_FAILURE","violations":[{"type":"TOS","subject":"google.com/cloud","description":"terms not accepted"}]}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+
+	t.Run("ResourceInfo", func(t *testing.T) {
+		detail := NewResourceInfo("sql table", "users", "acme-corp", "table is locked")
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"RESOURCE_INFO","resourceType":"sql table","resourceName":"users","owner":"acme-corp","description":"table is locked"}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+
+	t.Run("DebugInfo", func(t *testing.T) {
+		detail := NewDebugInfo([]string{"main.go:10", "main.go:20"}, "nil pointer dereference")
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"DEBUG_INFO","stackEntries":["main.go:10","main.go:20"],"detail":"nil pointer dereference"}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+
+	t.Run("Help", func(t *testing.T) {
+		detail := NewHelp([]HelpLink{{Description: "API docs", URL: "https://example.com/docs"}})
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"HELP","links":[{"description":"API docs","url":"https://example.com/docs"}]}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+
+	t.Run("RequestInfo", func(t *testing.T) {
+		detail := NewRequestInfo("req-123", "cursor=abc")
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		snapshot := `{"@type":"REQUEST_INFO","requestId":"req-123","servingData":"cursor=abc"}`
+		if string(body) != snapshot {
+			t.Errorf("expected body %s, got %s", snapshot, body)
+		}
+	})
+}
+
+func TestParseApiError(t *testing.T) {
+	t.Run("round-trips details into concrete types", func(t *testing.T) {
+		original := NewApiError(ErrorNotFound, "book not found", []ErrorDetail{
+			NewErrorInfo("BOOK_NOT_FOUND", map[string]any{"isbn": "0-061-96436-0"}),
+			NewBadRequest([]FieldViolation{{Field: "isbn", Description: "unknown isbn"}}),
+		})
+		rcrd := httptest.NewRecorder()
+		if err := original.WriteHTTPResponse(rcrd); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		parsed, err := ParseApiError(rcrd.Result())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if parsed.Code != original.Code || parsed.Message != original.Message {
+			t.Fatalf("expected %+v, got %+v", original, parsed)
+		}
+		info, ok := GetErrorInfo(parsed)
+		if !ok || info.Reason != "BOOK_NOT_FOUND" {
+			t.Errorf("expected ErrorInfo detail with reason BOOK_NOT_FOUND, got %+v, %v", info, ok)
+		}
+		badRequest, ok := GetBadRequest(parsed)
+		if !ok || len(badRequest.FieldViolations) != 1 || badRequest.FieldViolations[0].Field != "isbn" {
+			t.Errorf("expected BadRequest detail for field isbn, got %+v, %v", badRequest, ok)
+		}
+	})
+
+	t.Run("errors.Is matches on Code", func(t *testing.T) {
+		err := NewApiError(ErrorNotFound, "book not found", nil)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected errors.Is(err, ErrNotFound) to be true")
+		}
+		if errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("expected errors.Is(err, ErrAlreadyExists) to be false")
+		}
+	})
+
+	t.Run("Wrap/Unwrap exposes the cause", func(t *testing.T) {
+		cause := errors.New("sql: no rows in result set")
+		err := NewApiError(ErrorNotFound, "book not found", nil).Wrap(cause)
+		if !errors.Is(err, cause) {
+			t.Errorf("expected errors.Is(err, cause) to be true")
+		}
+		if errors.Unwrap(err) != cause {
+			t.Errorf("expected Unwrap to return the wrapped cause")
+		}
+	})
+}
+
+func TestRegisteredError(t *testing.T) {
+	t.Run("New attaches a domain-scoped ErrorInfo", func(t *testing.T) {
+		re := Register("library.example.com", "BOOK_NOT_FOUND", ErrorNotFound, "the requested book was not found")
+		apiErr := re.New(map[string]any{"isbn": "0-061-96436-0"})
+
+		if apiErr.Code != ErrorNotFound {
+			t.Errorf("expected code %s, got %s", ErrorNotFound, apiErr.Code)
+		}
+		info, ok := GetErrorInfo(apiErr)
+		if !ok {
+			t.Fatalf("expected an ErrorInfo detail")
+		}
+		if info.Domain != "library.example.com" || info.Reason != "BOOK_NOT_FOUND" {
+			t.Errorf("expected domain/reason library.example.com/BOOK_NOT_FOUND, got %s/%s", info.Domain, info.Reason)
+		}
+		if err := apiErr.Validate(); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("LookupReason finds a registered reason", func(t *testing.T) {
+		Register("library.example.com", "LOAN_LIMIT_EXCEEDED", ErrorResourceExhausted, "loan limit exceeded")
+		re, ok := LookupReason("library.example.com", "LOAN_LIMIT_EXCEEDED")
+		if !ok {
+			t.Fatalf("expected to find the registered reason")
+		}
+		if re.DefaultCode != ErrorResourceExhausted {
+			t.Errorf("expected default code %s, got %s", ErrorResourceExhausted, re.DefaultCode)
+		}
+		if _, ok := LookupReason("library.example.com", "UNKNOWN_REASON"); ok {
+			t.Errorf("expected not to find an unregistered reason")
+		}
+	})
+
+	t.Run("Register panics on a malformed reason", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected Register to panic on a malformed reason")
+			}
+		}()
+		Register("library.example.com", "not_upper_snake_case", ErrorInternal, "bad reason")
+	})
+
+	t.Run("Validate rejects a malformed metadata key", func(t *testing.T) {
+		apiErr := NewApiError(ErrorNotFound, "book not found", []ErrorDetail{
+			NewErrorInfo("BOOK_NOT_FOUND", map[string]any{"ISBN-code": "0-061-96436-0"}),
+		})
+		if err := apiErr.Validate(); err == nil {
+			t.Errorf("expected an error for the malformed metadata key")
+		}
+	})
+}
+
+func TestStackTrace(t *testing.T) {
+	t.Run("disabled by default", func(t *testing.T) {
+		err := NewApiError(ErrorInternal, "boom", nil)
+		if frames := err.StackTrace(); frames != nil {
+			t.Errorf("expected no stack trace, got %+v", frames)
+		}
+	})
+
+	t.Run("captured when enabled, first frame is the caller", func(t *testing.T) {
+		WithStackTrace(true)
+		defer WithStackTrace(false)
+
+		err := newApiErrorForStackTraceTest()
+		frames := err.StackTrace()
+		if len(frames) == 0 {
+			t.Fatalf("expected a captured stack trace")
+		}
+		if !strings.Contains(frames[0].Function, "newApiErrorForStackTraceTest") {
+			t.Errorf("expected first frame to be the caller of NewApiError, got %s", frames[0].Function)
+		}
+	})
+
+	t.Run("WriteHTTPResponseDebug appends a DebugInfo detail", func(t *testing.T) {
+		WithStackTrace(true)
+		defer WithStackTrace(false)
+
+		err := newApiErrorForStackTraceTest()
+		rcrd := httptest.NewRecorder()
+		if writeErr := err.WriteHTTPResponseDebug(rcrd, true); writeErr != nil {
+			t.Fatalf("expected no error, got %v", writeErr)
+		}
+		if len(err.Details) != 0 {
+			t.Errorf("expected the original ApiError's Details to be left untouched, got %+v", err.Details)
+		}
+
+		parsed, parseErr := ParseApiError(rcrd.Result())
+		if parseErr != nil {
+			t.Fatalf("expected no error, got %v", parseErr)
+		}
+		if len(parsed.Details) != 1 {
+			t.Fatalf("expected a single DebugInfo detail, got %+v", parsed.Details)
+		}
+		if _, ok := parsed.Details[0].(DebugInfo); !ok {
+			t.Errorf("expected a DebugInfo detail, got %T", parsed.Details[0])
+		}
+	})
+}
+
+func newApiErrorForStackTraceTest() ApiError {
+	return NewApiError(ErrorInternal, "boom", nil)
+}
+
+func BenchmarkNewApiError(b *testing.B) {
+	b.Run("stack trace disabled", func(b *testing.B) {
+		WithStackTrace(false)
+		for i := 0; i < b.N; i++ {
+			_ = NewApiError(ErrorInternal, "boom", nil)
+		}
+	})
+
+	b.Run("stack trace enabled", func(b *testing.B) {
+		WithStackTrace(true)
+		defer WithStackTrace(false)
+		for i := 0; i < b.N; i++ {
+			_ = NewApiError(ErrorInternal, "boom", nil)
+		}
+	})
+}
@@ -0,0 +1,225 @@
+// Package middleware provides net/http helpers built on top of the errors package: a panic
+// recoverer, an error-returning handler adapter, and content-negotiated error responses.
+package middleware
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	apierrors "github.com/doichev-kostia/errors-convention/go"
+	"golang.org/x/text/language"
+)
+
+// DevMode controls whether error responses include debugging details: Recover adds a DebugInfo
+// detail with the panic value and stack trace, and WriteError uses a non-ApiError's own message
+// instead of a generic one. It defaults to false so a production deployment never leaks internals
+// to a client; flip it on for local development.
+var DevMode atomic.Bool
+
+// ErrorHandler writes an HTTP response for an error returned by a HandlerFunc-wrapped handler.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// DefaultErrorHandler writes err via WriteError, which converts it to an ApiError if it isn't
+// one already and applies content negotiation based on the request's Accept header.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	_ = WriteError(w, r, err)
+}
+
+// HandlerFunc adapts fn into an http.Handler: when fn returns a non-nil error, onError is called
+// to write the response, so handlers can simply `return apierrors.NewApiError(...)` instead of
+// writing the error response themselves. A nil onError uses DefaultErrorHandler.
+func HandlerFunc(fn func(w http.ResponseWriter, r *http.Request) error, onError ErrorHandler) http.Handler {
+	if onError == nil {
+		onError = DefaultErrorHandler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(w, r); err != nil {
+			onError(w, r, err)
+		}
+	})
+}
+
+// Recover wraps next, converting any panic into an ApiError{Code: ErrorInternal} response
+// instead of letting it crash the server. When DevMode is enabled the response includes a
+// DebugInfo detail with the recovered value and a stack trace; otherwise the response carries no
+// detail, so internals are never exposed to clients in production.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			var details []apierrors.ErrorDetail
+			if DevMode.Load() {
+				buf := make([]byte, 4096)
+				n := runtime.Stack(buf, false)
+				details = []apierrors.ErrorDetail{apierrors.NewDebugInfo(nil, fmt.Sprintf("panic: %v\n%s", rec, buf[:n]))}
+			}
+			apiErr := apierrors.NewApiError(apierrors.ErrorInternal, "internal server error", details)
+			_ = apiErr.WriteHTTPResponse(w)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Content types recognized by WriteError's negotiation. Anything else falls back to JSON.
+const (
+	contentTypeJSON            = "application/json"
+	contentTypeProblemJSON     = "application/problem+json"
+	contentTypeGRPCStatusProto = "application/grpc-status+proto"
+)
+
+// WriteError writes err as an HTTP response on w, converting it to an ApiError (defaulting to
+// ErrorInternal if it isn't one already) and choosing the response format based on r's Accept
+// header: application/problem+json for an RFC 7807 problem details object, application/grpc-
+// status+proto for a protobuf-encoded google.rpc.Status, and application/json (the ApiError's own
+// WriteHTTPResponse format) otherwise.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	var apiErr apierrors.ApiError
+	if !stderrors.As(err, &apiErr) {
+		message := "internal server error"
+		if DevMode.Load() {
+			message = err.Error()
+		}
+		apiErr = apierrors.NewApiError(apierrors.ErrorInternal, message, nil)
+	}
+
+	switch negotiateContentType(r) {
+	case contentTypeProblemJSON:
+		return writeProblemJSON(w, r, apiErr)
+	case contentTypeGRPCStatusProto:
+		return writeGRPCStatusProto(w, apiErr)
+	default:
+		return apiErr.WriteHTTPResponse(w)
+	}
+}
+
+// negotiateContentType picks one of the content types WriteError knows how to produce based on
+// r's Accept header, defaulting to JSON. It does not weigh q-values or wildcards; the first
+// recognized media type in the header wins.
+func negotiateContentType(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case contentTypeProblemJSON, contentTypeGRPCStatusProto:
+			return mediaType
+		}
+	}
+	return contentTypeJSON
+}
+
+// LocalizedMessagePicker reads r's Accept-Language header and selects the best LocalizedMessage
+// among details using golang.org/x/text/language matching. It returns "" if details contains no
+// LocalizedMessage. With no Accept-Language header, or no match, it falls back to the first
+// LocalizedMessage, mirroring language.Matcher's own zero-value behavior.
+func LocalizedMessagePicker(r *http.Request, details []apierrors.ErrorDetail) string {
+	var messages []apierrors.LocalizedMessage
+	var tags []language.Tag
+	for _, d := range details {
+		lm, ok := d.(apierrors.LocalizedMessage)
+		if !ok {
+			continue
+		}
+		tag, err := language.Parse(lm.Locale)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, lm)
+		tags = append(tags, tag)
+	}
+	if len(messages) == 0 {
+		return ""
+	}
+
+	matcher := language.NewMatcher(tags)
+	accepted, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil || len(accepted) == 0 {
+		return messages[0].Message
+	}
+	_, index, _ := matcher.Match(accepted...)
+	return messages[index].Message
+}
+
+// writeProblemJSON writes apiErr as an RFC 7807 (application/problem+json) response: type is a
+// URN built from the error's ErrorInfo reason (or its Code if there is none), title is the
+// ApiError message, status is the mapped HTTP status, detail is the Accept-Language-negotiated
+// LocalizedMessage, and all of the ApiError's details, including those used for type and detail,
+// are carried in a "details" extension member.
+func writeProblemJSON(w http.ResponseWriter, r *http.Request, apiErr apierrors.ApiError) error {
+	status := apierrors.StatusCodeMap[apiErr.Code]
+
+	problem := map[string]any{
+		"type":   problemType(apiErr),
+		"title":  apiErr.Message,
+		"status": status,
+	}
+	if detail := LocalizedMessagePicker(r, apiErr.Details); detail != "" {
+		problem["detail"] = detail
+	}
+	if len(apiErr.Details) > 0 {
+		problem["details"] = apiErr.Details
+	}
+
+	w.Header().Set("Content-Type", contentTypeProblemJSON+"; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(problem)
+}
+
+// problemType derives the RFC 7807 "type" member: a URN naming the error's reason when it has an
+// ErrorInfo detail, otherwise one naming its Code.
+func problemType(apiErr apierrors.ApiError) string {
+	if info, ok := apierrors.GetErrorInfo(apiErr); ok && info.Reason != "" {
+		return "urn:error:" + info.Reason
+	}
+	return "urn:error:" + apiErr.Code.String()
+}
+
+// writeGRPCStatusProto writes apiErr as a protobuf-encoded google.rpc.Status message. Only the
+// code and message fields are encoded: faithfully encoding Details (a repeated google.protobuf.Any)
+// would require the generated protobuf/Any machinery this package deliberately avoids depending on.
+func writeGRPCStatusProto(w http.ResponseWriter, apiErr apierrors.ApiError) error {
+	body := encodeStatusProto(int32(apierrors.GRPCCodeMap[apiErr.Code]), apiErr.Message)
+	w.Header().Set("Content-Type", contentTypeGRPCStatusProto)
+	w.WriteHeader(apierrors.StatusCodeMap[apiErr.Code])
+	_, err := w.Write(body)
+	return err
+}
+
+// encodeStatusProto hand-encodes a google.rpc.Status message (field 1 "code" as a varint, field 2
+// "message" as a length-delimited string) using the protobuf wire format.
+func encodeStatusProto(code int32, message string) []byte {
+	buf := appendVarintField(nil, 1, uint64(code))
+	buf = appendStringField(buf, 2, message)
+	return buf
+}
+
+func appendVarintField(buf []byte, fieldNum int, v uint64) []byte {
+	const wireTypeVarint = 0
+	buf = appendVarint(buf, uint64(fieldNum)<<3|wireTypeVarint)
+	return appendVarint(buf, v)
+}
+
+func appendStringField(buf []byte, fieldNum int, s string) []byte {
+	const wireTypeLengthDelimited = 2
+	buf = appendVarint(buf, uint64(fieldNum)<<3|wireTypeLengthDelimited)
+	buf = appendVarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
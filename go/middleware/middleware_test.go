@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apierrors "github.com/doichev-kostia/errors-convention/go"
+)
+
+func TestHandlerFunc(t *testing.T) {
+	t.Run("calls through on success", func(t *testing.T) {
+		handler := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}, nil)
+		rcrd := httptest.NewRecorder()
+		handler.ServeHTTP(rcrd, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rcrd.Code != http.StatusNoContent {
+			t.Errorf("expected status %d, got %d", http.StatusNoContent, rcrd.Code)
+		}
+	})
+
+	t.Run("writes the returned error via the default handler", func(t *testing.T) {
+		handler := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return apierrors.NewApiError(apierrors.ErrorNotFound, "book not found", nil)
+		}, nil)
+		rcrd := httptest.NewRecorder()
+		handler.ServeHTTP(rcrd, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rcrd.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rcrd.Code)
+		}
+	})
+}
+
+func TestRecover(t *testing.T) {
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rcrd := httptest.NewRecorder()
+	handler.ServeHTTP(rcrd, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rcrd.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rcrd.Code)
+	}
+
+	parsed, err := apierrors.ParseApiError(rcrd.Result())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Code != apierrors.ErrorInternal {
+		t.Errorf("expected code %s, got %s", apierrors.ErrorInternal, parsed.Code)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	t.Run("defaults to JSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		rcrd := httptest.NewRecorder()
+		if err := WriteError(rcrd, r, apierrors.NewApiError(apierrors.ErrorNotFound, "book not found", nil)); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if ct := rcrd.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("expected JSON content type, got %s", ct)
+		}
+	})
+
+	t.Run("negotiates application/problem+json", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", contentTypeProblemJSON)
+		rcrd := httptest.NewRecorder()
+		apiErr := apierrors.NewApiError(apierrors.ErrorNotFound, "book not found", []apierrors.ErrorDetail{
+			apierrors.NewErrorInfo("BOOK_NOT_FOUND", nil),
+			apierrors.NewLocalizedMessage("en-US", "The book you requested was not found."),
+		})
+		if err := WriteError(rcrd, r, apiErr); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if rcrd.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rcrd.Code)
+		}
+		snapshot := `{"detail":"The book you requested was not found.","details":[{"@type":"ERROR_INFO","reason":"BOOK_NOT_FOUND","metadata":null},{"@type":"LOCALIZED_MESSAGE","locale":"en-US","message":"The book you requested was not found."}],"status":404,"title":"book not found","type":"urn:error:BOOK_NOT_FOUND"}`
+		if got := rcrd.Body.String(); got != snapshot+"\n" {
+			t.Errorf("expected body %s, got %s", snapshot, got)
+		}
+	})
+
+	t.Run("negotiates application/grpc-status+proto", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", contentTypeGRPCStatusProto)
+		rcrd := httptest.NewRecorder()
+		if err := WriteError(rcrd, r, apierrors.NewApiError(apierrors.ErrorNotFound, "book not found", nil)); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if ct := rcrd.Header().Get("Content-Type"); ct != contentTypeGRPCStatusProto {
+			t.Errorf("expected content type %s, got %s", contentTypeGRPCStatusProto, ct)
+		}
+		want := encodeStatusProto(int32(apierrors.GRPCCodeMap[apierrors.ErrorNotFound]), "book not found")
+		if got := rcrd.Body.Bytes(); string(got) != string(want) {
+			t.Errorf("expected body %x, got %x", want, got)
+		}
+	})
+
+	t.Run("non-ApiError defaults to ErrorInternal with a redacted message", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		rcrd := httptest.NewRecorder()
+		if err := WriteError(rcrd, r, errors.New("boom: connection refused")); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if rcrd.Code != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rcrd.Code)
+		}
+		parsed, err := apierrors.ParseApiError(rcrd.Result())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if parsed.Message != "internal server error" {
+			t.Errorf("expected the error message to be redacted, got %q", parsed.Message)
+		}
+	})
+
+	t.Run("non-ApiError includes the real message in DevMode", func(t *testing.T) {
+		DevMode.Store(true)
+		defer DevMode.Store(false)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		rcrd := httptest.NewRecorder()
+		if err := WriteError(rcrd, r, errors.New("boom: connection refused")); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		parsed, err := apierrors.ParseApiError(rcrd.Result())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if parsed.Message != "boom: connection refused" {
+			t.Errorf("expected the real error message in DevMode, got %q", parsed.Message)
+		}
+	})
+}
+
+func TestLocalizedMessagePicker(t *testing.T) {
+	details := []apierrors.ErrorDetail{
+		apierrors.NewLocalizedMessage("en-US", "not found"),
+		apierrors.NewLocalizedMessage("fr-FR", "introuvable"),
+	}
+
+	t.Run("matches the best available locale", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", "fr-CH, fr;q=0.9, en;q=0.1")
+		if got := LocalizedMessagePicker(r, details); got != "introuvable" {
+			t.Errorf("expected the French message, got %q", got)
+		}
+	})
+
+	t.Run("falls back to the first message without Accept-Language", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if got := LocalizedMessagePicker(r, details); got != "not found" {
+			t.Errorf("expected the first message, got %q", got)
+		}
+	})
+
+	t.Run("returns empty when there is no LocalizedMessage", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if got := LocalizedMessagePicker(r, []apierrors.ErrorDetail{apierrors.NewErrorInfo("X", nil)}); got != "" {
+			t.Errorf("expected an empty string, got %q", got)
+		}
+	})
+}